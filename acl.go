@@ -0,0 +1,81 @@
+package main
+
+import (
+    "strconv"
+    "strings"
+)
+
+// aclRule is one entry of the YAML rule engine: it matches a request by
+// user/destination/port and either allows or denies it. Rules are
+// evaluated in file order; the first match decides the outcome.
+type aclRule struct {
+    Action string   `yaml:"action"` // "allow" or "deny"
+    Users  []string `yaml:"users"`  // empty matches any user
+    Hosts  []string `yaml:"hosts"`  // CIDR, "*.domain" glob, or exact host; empty matches any host
+    Ports  []string `yaml:"ports"`  // exact ports or "low-high" ranges; empty matches any port
+}
+
+func (r aclRule) matches(ctx AuthContext, dstHost string, dstPort uint16) bool {
+    if len(r.Users) > 0 && !containsFold(r.Users, ctx.Username) {
+        return false
+    }
+    if len(r.Hosts) > 0 && !anyHostMatches(r.Hosts, dstHost) {
+        return false
+    }
+    if len(r.Ports) > 0 && !anyPortMatches(r.Ports, dstPort) {
+        return false
+    }
+    return true
+}
+
+func containsFold(list []string, s string) bool {
+    for _, v := range list {
+        if strings.EqualFold(v, s) {
+            return true
+        }
+    }
+    return false
+}
+
+func anyHostMatches(patterns []string, host string) bool {
+    for _, p := range patterns {
+        if (upstreamRoute{pattern: p}).matches(host) {
+            return true
+        }
+    }
+    return false
+}
+
+func anyPortMatches(patterns []string, port uint16) bool {
+    for _, p := range patterns {
+        if lo, hi, ok := strings.Cut(p, "-"); ok {
+            loN, err1 := strconv.Atoi(lo)
+            hiN, err2 := strconv.Atoi(hi)
+            if err1 == nil && err2 == nil && int(port) >= loN && int(port) <= hiN {
+                return true
+            }
+            continue
+        }
+        if n, err := strconv.Atoi(p); err == nil && uint16(n) == port {
+            return true
+        }
+    }
+    return false
+}
+
+// ConfigRuleSet is the RuleSet implementation backing the YAML "rules"
+// section. Default policy is allow: a destination is denied only if some
+// rule explicitly matches with action "deny", or if a "allow" allowlist is
+// present and nothing in it matches.
+type ConfigRuleSet struct {
+    Rules []aclRule
+}
+
+func (rs *ConfigRuleSet) Allow(ctx AuthContext, cmd byte, dstHost string, dstPort uint16) bool {
+    for _, r := range rs.Rules {
+        if r.matches(ctx, dstHost, dstPort) {
+            return strings.EqualFold(r.Action, "allow")
+        }
+    }
+    return true
+}
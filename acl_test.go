@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestAclRuleMatches(t *testing.T) {
+    cases := []struct {
+        name string
+        rule aclRule
+        ctx  AuthContext
+        host string
+        port uint16
+        want bool
+    }{
+        {
+            name: "empty rule matches anything",
+            rule: aclRule{},
+            ctx:  AuthContext{Username: "alice"},
+            host: "example.com",
+            port: 443,
+            want: true,
+        },
+        {
+            name: "user mismatch",
+            rule: aclRule{Users: []string{"bob"}},
+            ctx:  AuthContext{Username: "alice"},
+            host: "example.com",
+            port: 443,
+            want: false,
+        },
+        {
+            name: "user match is case-insensitive",
+            rule: aclRule{Users: []string{"Alice"}},
+            ctx:  AuthContext{Username: "alice"},
+            host: "example.com",
+            port: 443,
+            want: true,
+        },
+        {
+            name: "cidr does not match a hostname",
+            rule: aclRule{Hosts: []string{"10.0.0.0/8"}},
+            ctx:  AuthContext{},
+            host: "internal.evil.com",
+            port: 80,
+            want: false,
+        },
+        {
+            name: "cidr matches a literal IP in range",
+            rule: aclRule{Hosts: []string{"10.0.0.0/8"}},
+            ctx:  AuthContext{},
+            host: "10.1.2.3",
+            port: 80,
+            want: true,
+        },
+        {
+            name: "port range",
+            rule: aclRule{Ports: []string{"8000-8100"}},
+            ctx:  AuthContext{},
+            host: "example.com",
+            port: 8050,
+            want: true,
+        },
+        {
+            name: "port out of range",
+            rule: aclRule{Ports: []string{"8000-8100"}},
+            ctx:  AuthContext{},
+            host: "example.com",
+            port: 9000,
+            want: false,
+        },
+    }
+
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            if got := c.rule.matches(c.ctx, c.host, c.port); got != c.want {
+                t.Errorf("matches(%+v, %q, %d) = %v, want %v", c.ctx, c.host, c.port, got, c.want)
+            }
+        })
+    }
+}
+
+func TestConfigRuleSetAllow(t *testing.T) {
+    rs := &ConfigRuleSet{Rules: []aclRule{
+        {Action: "deny", Hosts: []string{"10.0.0.0/8"}},
+        {Action: "allow"},
+    }}
+
+    if rs.Allow(AuthContext{}, CMD_CONNECT, "10.1.2.3", 80) {
+        t.Error("expected deny rule to block a matching CIDR destination")
+    }
+    if !rs.Allow(AuthContext{}, CMD_CONNECT, "example.com", 80) {
+        t.Error("expected the catch-all allow rule to pass through a non-matching destination")
+    }
+}
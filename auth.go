@@ -0,0 +1,123 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+)
+
+// AuthContext carries what an Authenticator learned about the client so
+// downstream code (the RuleSet, access logs, quotas) can key off it.
+type AuthContext struct {
+    Method   byte
+    Username string
+}
+
+// Authenticator implements one SOCKS5 authentication method. Config holds
+// an ordered list of these; negotiateAuth picks the first one the client
+// also offered.
+type Authenticator interface {
+    GetCode() byte
+    Authenticate(r io.Reader, w io.Writer, clientAddr net.Addr) (*AuthContext, error)
+}
+
+// RuleSet lets an operator allow or deny a request after authentication
+// but before the server dials out.
+type RuleSet interface {
+    Allow(ctx AuthContext, cmd byte, dstHost string, dstPort uint16) bool
+}
+
+// allowAll is the default RuleSet used when Config.Rules is nil.
+type allowAll struct{}
+
+func (allowAll) Allow(AuthContext, byte, string, uint16) bool { return true }
+
+// NoAuthAuthenticator implements AUTH_NONE.
+type NoAuthAuthenticator struct{}
+
+func (NoAuthAuthenticator) GetCode() byte { return AUTH_NONE }
+
+func (NoAuthAuthenticator) Authenticate(io.Reader, io.Writer, net.Addr) (*AuthContext, error) {
+    return &AuthContext{Method: AUTH_NONE}, nil
+}
+
+// UserPassAuthenticator implements AUTH_USERNAME (RFC 1929).
+type UserPassAuthenticator struct {
+    Users map[string]string
+}
+
+func (UserPassAuthenticator) GetCode() byte { return AUTH_USERNAME }
+
+func (a UserPassAuthenticator) Authenticate(r io.Reader, w io.Writer, _ net.Addr) (*AuthContext, error) {
+    header := make([]byte, 2)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+    if header[0] != 0x01 {
+        return nil, errors.New("invalid authentication subprotocol version")
+    }
+
+    usernameLen := int(header[1])
+    username := make([]byte, usernameLen)
+    if _, err := io.ReadFull(r, username); err != nil {
+        return nil, err
+    }
+
+    passwordLenBuf := make([]byte, 1)
+    if _, err := io.ReadFull(r, passwordLenBuf); err != nil {
+        return nil, err
+    }
+    password := make([]byte, int(passwordLenBuf[0]))
+    if _, err := io.ReadFull(r, password); err != nil {
+        return nil, err
+    }
+
+    usernameStr := string(username)
+    storedPassword, exists := a.Users[usernameStr]
+    if !exists || storedPassword != string(password) {
+        w.Write([]byte{0x01, 0x01})
+        return nil, errors.New("invalid username or password")
+    }
+
+    if _, err := w.Write([]byte{0x01, 0x00}); err != nil {
+        return nil, err
+    }
+    return &AuthContext{Method: AUTH_USERNAME, Username: usernameStr}, nil
+}
+
+// RFC 1961 GSSAPI subnegotiation message types.
+const (
+    gssapiVersion    byte = 0x01
+    gssapiMtypeToken byte = 0x01
+)
+
+// readGSSAPIMessage reads one RFC 1961 framed message: version, mtyp, a
+// 2-byte big-endian length, then that many bytes of token.
+func readGSSAPIMessage(r io.Reader) (mtyp byte, token []byte, err error) {
+    header := make([]byte, 4)
+    if _, err = io.ReadFull(r, header); err != nil {
+        return 0, nil, err
+    }
+    if header[0] != gssapiVersion {
+        return 0, nil, errors.New("invalid GSSAPI subnegotiation version")
+    }
+    mtyp = header[1]
+    length := binary.BigEndian.Uint16(header[2:4])
+    token = make([]byte, length)
+    if _, err = io.ReadFull(r, token); err != nil {
+        return 0, nil, err
+    }
+    return mtyp, token, nil
+}
+
+// writeGSSAPIMessage frames a token the same way.
+func writeGSSAPIMessage(w io.Writer, mtyp byte, token []byte) error {
+    header := []byte{gssapiVersion, mtyp, 0, 0}
+    binary.BigEndian.PutUint16(header[2:4], uint16(len(token)))
+    if _, err := w.Write(header); err != nil {
+        return err
+    }
+    _, err := w.Write(token)
+    return err
+}
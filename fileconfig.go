@@ -0,0 +1,138 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// fileConfig is the on-disk YAML shape for --config. It's translated into
+// a Config by buildConfig; anything not representable there (flag-only
+// knobs like --krb5-keytab) simply isn't available in file-config mode.
+type fileConfig struct {
+    Listen         []string          `yaml:"listen"`
+    OutboundIfaces []string          `yaml:"outbound_ifaces"`
+    BindTimeout    time.Duration     `yaml:"bind_timeout"`
+    Users          map[string]string `yaml:"users"`
+    MetricsAddr    string            `yaml:"metrics_addr"`
+
+    Upstreams map[string][]string `yaml:"upstreams"` // chain name -> ordered socks5:// URLs
+    Routes    []struct {
+        Pattern string `yaml:"pattern"`
+        Chain   string `yaml:"chain"`
+    } `yaml:"routes"`
+
+    EgressRoutes []struct {
+        User    string `yaml:"user"`
+        Pattern string `yaml:"pattern"`
+        Iface   string `yaml:"iface"`
+    } `yaml:"egress_routes"`
+
+    Rules []aclRule `yaml:"rules"`
+
+    Limits map[string]struct {
+        BytesPerSecUp   int64         `yaml:"bytes_per_sec_up"`
+        BytesPerSecDown int64         `yaml:"bytes_per_sec_down"`
+        MaxConns        int           `yaml:"max_conns"`
+        IdleTimeout     time.Duration `yaml:"idle_timeout"`
+    } `yaml:"limits"`
+}
+
+// loadFileConfig reads and parses the YAML file at path into a Config.
+func loadFileConfig(path string) (*Config, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("reading config file %s: %w", path, err)
+    }
+
+    var fc fileConfig
+    if err := yaml.Unmarshal(data, &fc); err != nil {
+        return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+    }
+
+    return buildConfig(&fc)
+}
+
+// buildConfig translates a parsed fileConfig into the Config the server
+// actually runs with.
+func buildConfig(fc *fileConfig) (*Config, error) {
+    config := &Config{
+        BindTimeout: fc.BindTimeout,
+        Users:       fc.Users,
+        MetricsAddr: fc.MetricsAddr,
+    }
+    for _, name := range fc.OutboundIfaces {
+        iface, err := resolveEgressInterface(name)
+        if err != nil {
+            return nil, err
+        }
+        config.OutboundIfaces = append(config.OutboundIfaces, iface)
+    }
+    for _, r := range fc.EgressRoutes {
+        config.EgressRoutes = append(config.EgressRoutes, EgressRoute{User: r.User, Pattern: r.Pattern, Iface: r.Iface})
+    }
+    if config.Users == nil {
+        config.Users = make(map[string]string)
+    }
+    if config.BindTimeout == 0 {
+        config.BindTimeout = 60 * time.Second
+    }
+
+    if len(fc.Listen) == 0 {
+        config.ListenAddr = "0.0.0.0:1080"
+    } else {
+        config.ListenAddr = fc.Listen[0]
+        config.ExtraListenAddrs = fc.Listen[1:]
+    }
+
+    if len(config.Users) > 0 {
+        config.Authenticators = append(config.Authenticators, UserPassAuthenticator{Users: config.Users})
+    } else {
+        config.Authenticators = append(config.Authenticators, NoAuthAuthenticator{})
+    }
+
+    chains := make(map[string]*upstreamChain)
+    for name, urls := range fc.Upstreams {
+        var hops []upstreamHop
+        for _, raw := range urls {
+            hop, err := parseUpstreamHop(raw)
+            if err != nil {
+                return nil, fmt.Errorf("upstream chain %q: %w", name, err)
+            }
+            hops = append(hops, hop)
+        }
+        if len(hops) == 0 {
+            return nil, fmt.Errorf("upstream chain %q has no hops", name)
+        }
+        chains[name] = &upstreamChain{name: name, hops: hops}
+    }
+    config.UpstreamChains = chains
+
+    for _, r := range fc.Routes {
+        config.Routes = append(config.Routes, upstreamRoute{pattern: r.Pattern, chain: r.Chain})
+    }
+    if err := validateUpstreamRoutes(config.Routes, config.UpstreamChains); err != nil {
+        return nil, fmt.Errorf("routes: %w", err)
+    }
+
+    if len(fc.Rules) > 0 {
+        config.Rules = &ConfigRuleSet{Rules: fc.Rules}
+    }
+
+    if len(fc.Limits) > 0 {
+        limits := make(map[string]UserLimits, len(fc.Limits))
+        for user, l := range fc.Limits {
+            limits[user] = UserLimits{
+                BytesPerSecUp:   l.BytesPerSecUp,
+                BytesPerSecDown: l.BytesPerSecDown,
+                MaxConns:        l.MaxConns,
+                IdleTimeout:     l.IdleTimeout,
+            }
+        }
+        config.UserLimits = limits
+    }
+
+    return config, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+
+    "github.com/jcmturner/gofork/encoding/asn1"
+    "github.com/jcmturner/gokrb5/v8/gssapi"
+    "github.com/jcmturner/gokrb5/v8/keytab"
+    "github.com/jcmturner/gokrb5/v8/messages"
+    "github.com/jcmturner/gokrb5/v8/service"
+    "github.com/jcmturner/gokrb5/v8/types"
+)
+
+const AUTH_GSSAPI byte = 0x01
+
+// gssChecksumType is the CksumType an RFC 1964 §1.1.1 GSS-API checksum
+// carries in the AP-REQ Authenticator, as opposed to a plain Kerberos
+// checksum.
+const gssChecksumType int32 = 0x8003
+
+// GSS-API context establishment flags, from the Flags field of the
+// RFC 1964 §1.1.1 checksum (a 4-byte little-endian bitmask at offset 20
+// of the checksum bytes, following the 4-byte Lgth and 16-byte Bnd
+// fields).
+const (
+    gssFlagDeleg  = 1 << 0
+    gssFlagMutual = 1 << 1
+    gssFlagReplay = 1 << 2
+    gssFlagSeq    = 1 << 3
+    gssFlagConf   = 1 << 4
+    gssFlagInteg  = 1 << 5
+)
+
+// GSSAPIAuthenticator implements AUTH_GSSAPI (RFC 1961) for CONNECT-only
+// Kerberos authentication: it verifies the client's KRB_AP_REQ against a
+// keytab and reports the authenticated principal as AuthContext.Username.
+//
+// It does not implement the optional GSSAPI wrap/unwrap of subsequent
+// request bytes (integrity/confidentiality protection) — only the
+// authentication exchange itself. A client that negotiated
+// GSS_C_CONF_FLAG or GSS_C_INTEG_FLAG in its AP-REQ checksum is refused
+// rather than silently given an unprotected channel it didn't ask for.
+type GSSAPIAuthenticator struct {
+    Settings *service.Settings
+}
+
+// NewGSSAPIAuthenticator builds a GSSAPIAuthenticator that verifies
+// client tickets against the keytab at ktPath for the given service
+// principal.
+func NewGSSAPIAuthenticator(ktPath string) (*GSSAPIAuthenticator, error) {
+    kt, err := keytab.Load(ktPath)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load keytab %s: %w", ktPath, err)
+    }
+    return &GSSAPIAuthenticator{Settings: service.NewSettings(kt)}, nil
+}
+
+func (a *GSSAPIAuthenticator) GetCode() byte { return AUTH_GSSAPI }
+
+func (a *GSSAPIAuthenticator) Authenticate(r io.Reader, w io.Writer, _ net.Addr) (*AuthContext, error) {
+    mtyp, token, err := readGSSAPIMessage(r)
+    if err != nil {
+        return nil, err
+    }
+    if mtyp != gssapiMtypeToken {
+        return nil, fmt.Errorf("unexpected GSSAPI message type: 0x%02x", mtyp)
+    }
+
+    apReq, err := unmarshalKRB5APReqToken(token)
+    if err != nil {
+        writeGSSAPIMessage(w, gssapiMtypeToken, nil)
+        return nil, fmt.Errorf("invalid GSSAPI token: %w", err)
+    }
+
+    ok, creds, err := service.VerifyAPREQ(apReq, a.Settings)
+    if err != nil || !ok {
+        writeGSSAPIMessage(w, gssapiMtypeToken, nil)
+        if err == nil {
+            err = errors.New("KRB_AP_REQ verification failed")
+        }
+        return nil, err
+    }
+
+    if flags, ok := gssChecksumFlags(apReq.Authenticator.Cksum); ok && flags&(gssFlagConf|gssFlagInteg) != 0 {
+        writeGSSAPIMessage(w, gssapiMtypeToken, nil)
+        return nil, errors.New("GSSAPI: client requested confidentiality/integrity protection, which this server does not implement")
+    }
+
+    // Acknowledge success. A full implementation would return a mutual
+    // authentication AP-REP token here; gokrb5 does not currently expose
+    // the server-side machinery to build one, so we just signal completion.
+    if err := writeGSSAPIMessage(w, gssapiMtypeToken, nil); err != nil {
+        return nil, err
+    }
+
+    return &AuthContext{Method: AUTH_GSSAPI, Username: creds.UserName()}, nil
+}
+
+// gssChecksumFlags extracts the context establishment Flags from an
+// RFC 1964 §1.1.1 GSS-API checksum, if cksum is one (CksumType
+// gssChecksumType). The checksum body is Lgth(4 bytes, little-endian,
+// always 16) || Bnd(16 bytes, channel bindings) || Flags(4 bytes,
+// little-endian). ok is false if cksum isn't a GSS-API checksum or is
+// too short to contain a Flags field, in which case no flags were
+// negotiated to reject.
+func gssChecksumFlags(cksum types.Checksum) (flags uint32, ok bool) {
+    if cksum.CksumType != gssChecksumType || len(cksum.Checksum) < 24 {
+        return 0, false
+    }
+    b := cksum.Checksum[20:24]
+    return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24, true
+}
+
+// unmarshalKRB5APReqToken strips the GSS-API generic token framing
+// (APPLICATION 0 tag wrapping the mechanism OID) to get to the raw
+// KRB_AP_REQ, per RFC 1964 section 1.
+func unmarshalKRB5APReqToken(b []byte) (*messages.APReq, error) {
+    var oid asn1.ObjectIdentifier
+    rest, err := asn1.UnmarshalWithParams(b, &oid, "application,explicit,tag:0")
+    if err != nil {
+        return nil, fmt.Errorf("error unmarshalling GSSAPI token OID: %w", err)
+    }
+    if !oid.Equal(gssapi.OIDKRB5.OID()) {
+        return nil, fmt.Errorf("unsupported GSSAPI mechanism OID: %s", oid.String())
+    }
+    if len(rest) < 2 {
+        return nil, errors.New("GSSAPI token too short")
+    }
+    // rest[0:2] is the inner token ID; 0x0100 marks a KRB_AP_REQ.
+    if rest[0] != 0x01 || rest[1] != 0x00 {
+        return nil, fmt.Errorf("expected KRB_AP_REQ inner token, got %02x%02x", rest[0], rest[1])
+    }
+
+    var apReq messages.APReq
+    if err := apReq.Unmarshal(rest[2:]); err != nil {
+        return nil, fmt.Errorf("error unmarshalling AP_REQ: %w", err)
+    }
+    return &apReq, nil
+}
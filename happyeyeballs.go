@@ -0,0 +1,350 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// happyEyeballsDelay is the stagger between successive connection
+// attempts, per RFC 8305's recommended 250ms "Connection Attempt Delay".
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// EgressInterface is one operator-configured outbound interface, resolved
+// once at config load time into the source addresses Happy Eyeballs binds
+// each connection family to. Either address may be nil if the interface
+// doesn't have one.
+type EgressInterface struct {
+    Name string
+    V4   net.IP
+    V6   net.IP
+}
+
+// EgressRoute pins traffic to a named egress interface. Routes are
+// evaluated in order; the first match wins. An empty User or Pattern
+// matches anything for that field.
+type EgressRoute struct {
+    User    string
+    Pattern string
+    Iface   string
+}
+
+// resolveEgressInterface looks up the named network interface and
+// extracts its first non-loopback IPv4 and IPv6 addresses.
+func resolveEgressInterface(name string) (EgressInterface, error) {
+    iface, err := net.InterfaceByName(name)
+    if err != nil {
+        return EgressInterface{}, fmt.Errorf("interface %s: %w", name, err)
+    }
+    addrs, err := iface.Addrs()
+    if err != nil {
+        return EgressInterface{}, fmt.Errorf("interface %s: %w", name, err)
+    }
+
+    result := EgressInterface{Name: name}
+    for _, addr := range addrs {
+        ipnet, ok := addr.(*net.IPNet)
+        if !ok || ipnet.IP.IsLoopback() {
+            continue
+        }
+        if v4 := ipnet.IP.To4(); v4 != nil {
+            if result.V4 == nil {
+                result.V4 = v4
+            }
+        } else if result.V6 == nil {
+            result.V6 = ipnet.IP
+        }
+    }
+    return result, nil
+}
+
+// parseEgressIfaces resolves a comma-separated list of interface names
+// (the --iface flag) into EgressInterfaces, in the given order.
+func parseEgressIfaces(spec string) ([]EgressInterface, error) {
+    var ifaces []EgressInterface
+    for _, name := range strings.Split(spec, ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        iface, err := resolveEgressInterface(name)
+        if err != nil {
+            return nil, err
+        }
+        ifaces = append(ifaces, iface)
+    }
+    return ifaces, nil
+}
+
+// parseEgressRoutes parses the --egress-routes flag value:
+// "pattern=iface,pattern=iface,...". Per-user pinning is only available
+// through the YAML config's egress_routes list.
+func parseEgressRoutes(spec string) ([]EgressRoute, error) {
+    var routes []EgressRoute
+    if spec == "" {
+        return routes, nil
+    }
+    for _, raw := range strings.Split(spec, ",") {
+        raw = strings.TrimSpace(raw)
+        if raw == "" {
+            continue
+        }
+        idx := strings.Index(raw, "=")
+        if idx == -1 {
+            return nil, fmt.Errorf("invalid egress route %q, expected pattern=iface", raw)
+        }
+        routes = append(routes, EgressRoute{Pattern: raw[:idx], Iface: raw[idx+1:]})
+    }
+    return routes, nil
+}
+
+// egressInterface resolves which configured interface CONNECT/BIND/UDP
+// ASSOCIATE should source traffic from for user dialing dstHost,
+// consulting EgressRoutes in order before falling back to the first
+// configured interface.
+func (c *Config) egressInterface(user, dstHost string) *EgressInterface {
+    for _, r := range c.EgressRoutes {
+        if r.User != "" && !strings.EqualFold(r.User, user) {
+            continue
+        }
+        if r.Pattern != "" && !(upstreamRoute{pattern: r.Pattern}).matches(dstHost) {
+            continue
+        }
+        for i := range c.OutboundIfaces {
+            if c.OutboundIfaces[i].Name == r.Iface {
+                return &c.OutboundIfaces[i]
+            }
+        }
+    }
+    if len(c.OutboundIfaces) > 0 {
+        return &c.OutboundIfaces[0]
+    }
+    return nil
+}
+
+// egressIP is egressInterface plus the v4/v6 selection dialCandidate and
+// the BIND/UDP ASSOCIATE listeners need.
+func (c *Config) egressIP(user, dstHost string, v6 bool) net.IP {
+    iface := c.egressInterface(user, dstHost)
+    if iface == nil {
+        return nil
+    }
+    if v6 {
+        return iface.V6
+    }
+    return iface.V4
+}
+
+// hostIsIPv6 reports whether host is a literal IPv6 address, for callers
+// that need to pick egressIP's v4/v6 family but (unlike dialCandidate,
+// which has an already-resolved net.IPAddr) only have the client-supplied
+// host string and don't resolve it themselves. Domain names default to
+// v4, matching those call sites' pre-existing behavior.
+func hostIsIPv6(host string) bool {
+    ip := net.ParseIP(host)
+    return ip != nil && ip.To4() == nil
+}
+
+// dialHappyEyeballs implements RFC 8305 Happy Eyeballs v2: it resolves
+// host to both A and AAAA records, races connections to them with a
+// staggered start, and returns the winner while canceling the rest.
+// Literal IP addresses skip resolution and racing entirely.
+func dialHappyEyeballs(ctx context.Context, config *Config, user, host string, port uint16) (net.Conn, error) {
+    if ip := net.ParseIP(host); ip != nil {
+        return dialCandidate(ctx, config, user, host, net.IPAddr{IP: ip}, port)
+    }
+
+    resolveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    addrs, err := net.DefaultResolver.LookupIPAddr(resolveCtx, host)
+    cancel()
+    if err != nil {
+        return nil, err
+    }
+    if len(addrs) == 0 {
+        return nil, fmt.Errorf("no addresses found for %s", host)
+    }
+
+    var srcV4, srcV6 net.IP
+    if iface := config.egressInterface(user, host); iface != nil {
+        srcV4, srcV6 = iface.V4, iface.V6
+    }
+    return raceDial(ctx, config, user, host, sortHappyEyeballs(addrs, srcV4, srcV6), port)
+}
+
+// sortHappyEyeballs orders resolved addresses for racing. Within each
+// address family it approximates RFC 6724 rule 9 (longest matching
+// prefix) against the source address this server would actually bind
+// from; across families it interleaves v4/v6 so a slow or dead family
+// can't starve attempts to the other, leading with whichever family the
+// resolver returned first.
+func sortHappyEyeballs(addrs []net.IPAddr, srcV4, srcV6 net.IP) []net.IPAddr {
+    var v4, v6 []net.IPAddr
+    for _, a := range addrs {
+        if a.IP.To4() != nil {
+            v4 = append(v4, a)
+        } else {
+            v6 = append(v6, a)
+        }
+    }
+    sortByPrefixMatch(v4, srcV4)
+    sortByPrefixMatch(v6, srcV6)
+
+    first, second := v4, v6
+    if addrs[0].IP.To4() == nil {
+        first, second = v6, v4
+    }
+    out := make([]net.IPAddr, 0, len(addrs))
+    for len(first) > 0 || len(second) > 0 {
+        if len(first) > 0 {
+            out = append(out, first[0])
+            first = first[1:]
+        }
+        if len(second) > 0 {
+            out = append(out, second[0])
+            second = second[1:]
+        }
+    }
+    return out
+}
+
+func sortByPrefixMatch(addrs []net.IPAddr, src net.IP) {
+    if src == nil || len(addrs) < 2 {
+        return
+    }
+    sort.SliceStable(addrs, func(i, j int) bool {
+        return commonPrefixLen(addrs[i].IP, src) > commonPrefixLen(addrs[j].IP, src)
+    })
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b net.IP) int {
+    a4, b4 := a.To4(), b.To4()
+    var ab, bb []byte
+    if a4 != nil && b4 != nil {
+        ab, bb = a4, b4
+    } else {
+        ab, bb = a.To16(), b.To16()
+    }
+    if ab == nil || bb == nil || len(ab) != len(bb) {
+        return 0
+    }
+    n := 0
+    for i := range ab {
+        x := ab[i] ^ bb[i]
+        if x == 0 {
+            n += 8
+            continue
+        }
+        for x&0x80 == 0 {
+            n++
+            x <<= 1
+        }
+        break
+    }
+    return n
+}
+
+// raceDial dials candidates in order with a happyEyeballsDelay stagger,
+// returning the first successful connection and canceling the rest. host
+// is the original hostname the client asked to reach (for EgressRoutes
+// matching domain globs); candidates are its resolved addresses.
+func raceDial(ctx context.Context, config *Config, user, host string, candidates []net.IPAddr, port uint16) (net.Conn, error) {
+    if len(candidates) == 0 {
+        return nil, errors.New("happy eyeballs: no candidate addresses")
+    }
+
+    raceCtx, cancel := context.WithCancel(ctx)
+
+    type attempt struct {
+        conn net.Conn
+        err  error
+    }
+    results := make(chan attempt, len(candidates))
+    var wg sync.WaitGroup
+
+    for i, addr := range candidates {
+        wg.Add(1)
+        go func(i int, addr net.IPAddr) {
+            defer wg.Done()
+            timer := time.NewTimer(time.Duration(i) * happyEyeballsDelay)
+            defer timer.Stop()
+            select {
+            case <-timer.C:
+            case <-raceCtx.Done():
+                return
+            }
+            conn, err := dialCandidate(raceCtx, config, user, host, addr, port)
+            select {
+            case results <- attempt{conn, err}:
+            case <-raceCtx.Done():
+                if conn != nil {
+                    conn.Close()
+                }
+            }
+        }(i, addr)
+    }
+
+    go func() {
+        wg.Wait()
+        close(results)
+    }()
+
+    var firstErr error
+    for r := range results {
+        if r.err == nil {
+            cancel()
+            go func() {
+                for late := range results {
+                    if late.conn != nil {
+                        late.conn.Close()
+                    }
+                }
+            }()
+            return r.conn, nil
+        }
+        if firstErr == nil {
+            firstErr = r.err
+        }
+    }
+    cancel()
+    if firstErr == nil {
+        firstErr = errors.New("happy eyeballs: all candidates failed")
+    }
+    return nil, firstErr
+}
+
+// dialCandidate dials a single resolved address, binding to the
+// egress-configured source address for that address's family. host is
+// the original hostname (or literal IP, from dialHappyEyeballs' literal
+// fast path) used for EgressRoutes matching — not addr, which is one of
+// possibly several resolved IPs and won't match a domain-glob pattern.
+//
+// The rule set is re-checked here against addr, the resolved IP, not
+// just host: handleRequest only ever validated the client-supplied
+// (pre-resolution) hostname, so a CIDR deny rule meant to block an IP
+// range would never fire against a hostname that happens to resolve
+// into it (DNS rebinding). This is a second, independent check —
+// omitting it here would let the resolved destination bypass CIDR
+// rules entirely.
+func dialCandidate(ctx context.Context, config *Config, user, host string, addr net.IPAddr, port uint16) (net.Conn, error) {
+    rules := config.Rules
+    if rules == nil {
+        rules = allowAll{}
+    }
+    if !rules.Allow(AuthContext{Username: user}, CMD_CONNECT, addr.IP.String(), port) {
+        return nil, fmt.Errorf("connection to %s (resolved from %s) denied by rule set", addr.IP, host)
+    }
+
+    dialer := &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}
+    v6 := addr.IP.To4() == nil
+    if src := config.egressIP(user, host, v6); src != nil {
+        dialer.LocalAddr = &net.TCPAddr{IP: src}
+    }
+    return dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(port))))
+}
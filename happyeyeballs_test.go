@@ -0,0 +1,66 @@
+package main
+
+import (
+    "net"
+    "testing"
+)
+
+func ipAddrs(ips ...string) []net.IPAddr {
+    out := make([]net.IPAddr, len(ips))
+    for i, s := range ips {
+        out[i] = net.IPAddr{IP: net.ParseIP(s)}
+    }
+    return out
+}
+
+func ipStrings(addrs []net.IPAddr) []string {
+    out := make([]string, len(addrs))
+    for i, a := range addrs {
+        out[i] = a.IP.String()
+    }
+    return out
+}
+
+func TestSortHappyEyeballsInterleavesFamilies(t *testing.T) {
+    addrs := ipAddrs("192.0.2.1", "192.0.2.2", "2001:db8::1")
+    got := ipStrings(sortHappyEyeballs(addrs, nil, nil))
+
+    // The resolver returned v4 first, so the interleave should lead with
+    // v4 and alternate in, not exhaust one family before the other.
+    want := []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}
+    if !equalStrings(got, want) {
+        t.Errorf("sortHappyEyeballs() = %v, want %v", got, want)
+    }
+}
+
+func TestSortHappyEyeballsLeadsWithResolverOrder(t *testing.T) {
+    addrs := ipAddrs("2001:db8::1", "192.0.2.1")
+    got := ipStrings(sortHappyEyeballs(addrs, nil, nil))
+
+    want := []string{"2001:db8::1", "192.0.2.1"}
+    if !equalStrings(got, want) {
+        t.Errorf("sortHappyEyeballs() = %v, want %v", got, want)
+    }
+}
+
+func TestSortHappyEyeballsPrefersLongestPrefixMatch(t *testing.T) {
+    addrs := ipAddrs("198.51.100.1", "192.0.2.1")
+    src := net.ParseIP("192.0.2.200")
+
+    got := ipStrings(sortHappyEyeballs(addrs, src, nil))
+    if got[0] != "192.0.2.1" {
+        t.Errorf("sortHappyEyeballs() = %v, want 192.0.2.1 (longer prefix match with source) first", got)
+    }
+}
+
+func equalStrings(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
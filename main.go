@@ -2,6 +2,7 @@ package main
 
 import (
     "bufio"
+    "context"
     "encoding/binary"
     "errors"
     "flag"
@@ -13,6 +14,7 @@ import (
     "os/signal"
     "strings"
     "sync"
+    "sync/atomic"
     "syscall"
     "time"
 )
@@ -21,6 +23,8 @@ import (
 const (
     VERSION            byte = 0x05
     CMD_CONNECT       byte = 0x01
+    CMD_BIND          byte = 0x02
+    CMD_UDP_ASSOCIATE byte = 0x03
     ATYP_IPV4         byte = 0x01
     ATYP_DOMAINNAME   byte = 0x03
     ATYP_IPV6         byte = 0x04
@@ -44,23 +48,53 @@ const (
 
 // Configuration
 type Config struct {
-    ListenAddr    string
-    OutboundIface string
-    Users         map[string]string
+    ListenAddr        string
+    ExtraListenAddrs  []string
+    OutboundIfaces    []EgressInterface
+    EgressRoutes      []EgressRoute
+    Users             map[string]string
+    BindTimeout       time.Duration
+    Authenticators    []Authenticator
+    Rules             RuleSet
+    UpstreamChains    map[string]*upstreamChain
+    Routes            []upstreamRoute
+    UserLimits        map[string]UserLimits
+    MetricsAddr       string
 }
 
+// quotas tracks live per-user connection counts across every listener and
+// config reload; it isn't part of the reloadable Config because it needs
+// to persist across the atomic swaps a --config hot-reload performs.
+var quotas = newQuotaTracker()
+
 func main() {
     var config Config
-    
+
     // Parse command line flags
     listenAddr := flag.String("listen", "0.0.0.0:1080", "Listen address and port")
     listenAddrShort := flag.String("l", "0.0.0.0:1080", "Listen address and port (short)")
-    outIface := flag.String("iface", "", "Outbound network interface")
-    outIfaceShort := flag.String("i", "", "Outbound network interface (short)")
+    outIface := flag.String("iface", "", "Outbound network interface(s), comma-separated (e.g. eth0,eth1)")
+    outIfaceShort := flag.String("i", "", "Outbound network interface(s) (short)")
+    egressRoutes := flag.String("egress-routes", "", "Per-destination egress interface pinning: pattern=iface,pattern=iface,... (pattern is a CIDR, *.domain glob, or exact host)")
     userFile := flag.String("users", "", "User file (format: username:password)")
     userFileShort := flag.String("u", "", "User file (short)")
+    bindTimeout := flag.Duration("bind-timeout", 60*time.Second, "Timeout waiting for the inbound connection on a BIND request")
+    krb5Keytab := flag.String("krb5-keytab", "", "Keytab file enabling AUTH_GSSAPI (Kerberos) authentication")
+    upstream := flag.String("upstream", "", "Upstream SOCKS5 chain(s): [name=]socks5://[user:pass@]host:port[,socks5://...][;name=...]")
+    upstreamRoutes := flag.String("upstream-routes", "", "Per-destination chain routing: pattern=chain,pattern=chain,... (pattern is a CIDR, *.domain glob, or exact host)")
+    configPath := flag.String("config", "", "YAML config file. When set, it replaces the flags above and is hot-reloaded on change")
+    metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on (e.g. :9090). Disabled if empty")
     flag.Parse()
 
+    if *metricsAddr != "" {
+        go serveMetrics(*metricsAddr)
+    }
+
+    if *configPath != "" {
+        runWithFileConfig(*configPath)
+        return
+    }
+
     // Merge short and long flags (short takes precedence if both set)
     if *listenAddrShort != "0.0.0.0:1080" {
         listenAddr = listenAddrShort
@@ -78,13 +112,23 @@ func main() {
     } else {
         config.ListenAddr = *listenAddr
     }
-    if v := os.Getenv("PROXY_IFACE"); v != "" && *outIface == "" {
-        config.OutboundIface = v
-    } else {
-        config.OutboundIface = *outIface
+    ifaceSpec := *outIface
+    if v := os.Getenv("PROXY_IFACE"); v != "" && ifaceSpec == "" {
+        ifaceSpec = v
+    }
+    ifaces, err := parseEgressIfaces(ifaceSpec)
+    if err != nil {
+        log.Fatalf("Error resolving --iface: %v", err)
+    }
+    config.OutboundIfaces = ifaces
+    egressRoutesParsed, err := parseEgressRoutes(*egressRoutes)
+    if err != nil {
+        log.Fatalf("Error parsing --egress-routes: %v", err)
     }
+    config.EgressRoutes = egressRoutesParsed
     config.Users = make(map[string]string)
-    
+    config.BindTimeout = *bindTimeout
+
     // Load users from file
     usersPath := *userFile
     if usersPath == "" {
@@ -98,7 +142,37 @@ func main() {
     
     // Check if authentication is required
     requireAuth := len(config.Users) > 0
-    
+
+    // Build the authenticator chain: username/password (or none) plus,
+    // optionally, Kerberos via GSSAPI. RuleSet is left nil (allow-all)
+    // until an operator wires one up.
+    if requireAuth {
+        config.Authenticators = append(config.Authenticators, UserPassAuthenticator{Users: config.Users})
+    } else {
+        config.Authenticators = append(config.Authenticators, NoAuthAuthenticator{})
+    }
+    if *krb5Keytab != "" {
+        gssapiAuth, err := NewGSSAPIAuthenticator(*krb5Keytab)
+        if err != nil {
+            log.Fatalf("Error configuring GSSAPI authentication: %v", err)
+        }
+        config.Authenticators = append(config.Authenticators, gssapiAuth)
+    }
+
+    chains, err := parseUpstreamChains(*upstream)
+    if err != nil {
+        log.Fatalf("Error parsing --upstream: %v", err)
+    }
+    config.UpstreamChains = chains
+    routes, err := parseUpstreamRoutes(*upstreamRoutes)
+    if err != nil {
+        log.Fatalf("Error parsing --upstream-routes: %v", err)
+    }
+    if err := validateUpstreamRoutes(routes, chains); err != nil {
+        log.Fatalf("Error in --upstream-routes: %v", err)
+    }
+    config.Routes = routes
+
     // Start the server
     listener, err := net.Listen("tcp", config.ListenAddr)
     if err != nil {
@@ -116,19 +190,24 @@ func main() {
     }()
     
     log.Printf("SOCKS5 proxy started on %s", config.ListenAddr)
-    if config.OutboundIface != "" {
-        if ip := getInterfaceIP(config.OutboundIface); ip != nil {
-            log.Printf("Outbound traffic through interface: %s (%s)", config.OutboundIface, ip.String())
-        } else {
-            log.Printf("Warning: interface %s not found or no IPv4 address; using default routing", config.OutboundIface)
-        }
+    for _, iface := range config.OutboundIfaces {
+        log.Printf("Outbound interface %s: v4=%v v6=%v", iface.Name, iface.V4, iface.V6)
     }
     if requireAuth {
         log.Printf("Authentication enabled, loaded %d users", len(config.Users))
     } else {
         log.Printf("Authentication disabled")
     }
-    
+
+    var cfgPtr atomic.Pointer[Config]
+    cfgPtr.Store(&config)
+    serve(listener, &cfgPtr)
+}
+
+// serve accepts connections on listener until it's closed, handing each
+// one to handleConnection along with whatever Config is current at that
+// moment (cfgPtr may be swapped concurrently by a config-file reload).
+func serve(listener net.Listener, cfgPtr *atomic.Pointer[Config]) {
     for {
         conn, err := listener.Accept()
         if err != nil {
@@ -140,7 +219,7 @@ func main() {
             log.Printf("Accept error: %v", err)
             continue
         }
-        go handleConnection(conn, &config)
+        go handleConnection(conn, cfgPtr.Load())
     }
 }
 
@@ -185,211 +264,231 @@ func handleConnection(conn net.Conn, config *Config) {
         tc.SetKeepAlive(true)
         tc.SetKeepAlivePeriod(30 * time.Second)
     }
-    
+
+    entry := newAccessEntry(conn.RemoteAddr())
+    defer entry.log()
+
+    ctx, endSession := startSpan(context.Background(), "socks-session")
+    defer endSession()
+
     // Deadlines for handshake
     conn.SetDeadline(time.Now().Add(15 * time.Second))
     // Authentication negotiation
-    if err := negotiateAuth(conn, config); err != nil {
+    authCtx, err := negotiateAuthTraced(ctx, conn, config)
+    if err != nil {
 	log.Printf("Authentication error: %v", err)
+	entry.reply = replyAuthFailed
+	metrics.recordConnection(0, entry.reply)
 	return
     }
-    
+    entry.user = authCtx.Username
+
+    limits := config.UserLimits[authCtx.Username]
+    if !quotas.acquire(authCtx.Username, limits) {
+        log.Printf("Connection limit reached for user %q, rejecting", authCtx.Username)
+        writeReply(conn, REP_NOT_ALLOWED, nil, 0)
+        entry.reply = REP_NOT_ALLOWED
+        metrics.recordConnection(authCtx.Method, entry.reply)
+        return
+    }
+    defer quotas.release(authCtx.Username, limits)
+
+    if limits.IdleTimeout > 0 {
+        conn = &idleTimeoutConn{Conn: conn, timeout: limits.IdleTimeout}
+    }
+
     // Process SOCKS request
-    if err := handleRequest(conn, config); err != nil {
+    if err := handleRequest(ctx, conn, config, authCtx, limits, entry); err != nil {
 	log.Printf("Request handling error: %v", err)
-	return
     }
+    metrics.recordConnection(authCtx.Method, entry.reply)
 }
 
-// Negotiate authentication methods
-func negotiateAuth(conn net.Conn, config *Config) error {
+// negotiateAuthTraced wraps negotiateAuth in an "auth" span so a slow
+// Kerberos exchange or ACL lookup is visible in a session's trace.
+func negotiateAuthTraced(ctx context.Context, conn net.Conn, config *Config) (*AuthContext, error) {
+    _, end := startSpan(ctx, "auth")
+    defer end()
+    return negotiateAuth(conn, config)
+}
+
+// Negotiate authentication methods against the authenticators registered
+// on config, in the order the client offered them.
+func negotiateAuth(conn net.Conn, config *Config) (*AuthContext, error) {
     // First packet with authentication methods
     header := make([]byte, 2)
     if _, err := io.ReadFull(conn, header); err != nil {
-	return err
+	return nil, err
     }
-    
+
     if header[0] != VERSION {
-	return errors.New("invalid protocol version")
+	return nil, errors.New("invalid protocol version")
     }
-    
+
     methodCount := int(header[1])
     methods := make([]byte, methodCount)
     if _, err := io.ReadFull(conn, methods); err != nil {
-	return err
+	return nil, err
     }
-    
-    // Check for required authentication method
-    requireAuth := len(config.Users) > 0
-    chosenMethod := AUTH_NOACCEPT
-    
+
+    var chosen Authenticator
     for _, method := range methods {
-	if requireAuth && method == AUTH_USERNAME {
-	    chosenMethod = AUTH_USERNAME
-	    break
-	} else if !requireAuth && method == AUTH_NONE {
-	    chosenMethod = AUTH_NONE
-	    break
-	}
-    }
-    
-    // Send chosen method
-    if _, err := conn.Write([]byte{VERSION, chosenMethod}); err != nil {
-	return err
+        for _, a := range config.Authenticators {
+            if a.GetCode() == method {
+                chosen = a
+                break
+            }
+        }
+        if chosen != nil {
+            break
+        }
     }
-    
-    // If method is not acceptable, close connection
-    if chosenMethod == AUTH_NOACCEPT {
-	return errors.New("no supported authentication methods")
+
+    if chosen == nil {
+        conn.Write([]byte{VERSION, AUTH_NOACCEPT})
+        return nil, errors.New("no supported authentication methods")
     }
-    
-    // Verify credentials if authentication required
-    if chosenMethod == AUTH_USERNAME {
-	auth := make([]byte, 2)
-	if _, err := io.ReadFull(conn, auth); err != nil {
-	    return err
-	}
-	
-	if auth[0] != 0x01 {
-	    return errors.New("invalid authentication subprotocol version")
-	}
-	
-	// Read username
-	usernameLen := int(auth[1])
-	username := make([]byte, usernameLen)
-	if _, err := io.ReadFull(conn, username); err != nil {
-	    return err
-	}
-	
-	// Read password
-	passwordLenBuf := make([]byte, 1)
-	if _, err := io.ReadFull(conn, passwordLenBuf); err != nil {
-	    return err
-	}
-	
-	passwordLen := int(passwordLenBuf[0])
-	password := make([]byte, passwordLen)
-	if _, err := io.ReadFull(conn, password); err != nil {
-	    return err
-	}
-	
-	// Verify credentials
-	usernameStr := string(username)
-	passwordStr := string(password)
-	
-	storedPassword, exists := config.Users[usernameStr]
-	if !exists || storedPassword != passwordStr {
-	    // Send authentication status: failure
-	    conn.Write([]byte{0x01, 0x01})
-	    return errors.New("invalid username or password")
-	}
-	
-	// Send authentication status: success
-	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
-	    return err
-	}
+
+    if _, err := conn.Write([]byte{VERSION, chosen.GetCode()}); err != nil {
+	return nil, err
     }
-    
-    return nil
+
+    return chosen.Authenticate(conn, conn, conn.RemoteAddr())
 }
 
 // Handle SOCKS request
-func handleRequest(conn net.Conn, config *Config) error {
+func handleRequest(ctx context.Context, conn net.Conn, config *Config, authCtx *AuthContext, limits UserLimits, entry *accessEntry) error {
     // Read request header
     header := make([]byte, 4)
     if _, err := io.ReadFull(conn, header); err != nil {
 	return err
     }
-    
+
     if header[0] != VERSION {
 	return errors.New("invalid protocol version")
     }
-    
-    if header[1] != CMD_CONNECT {
+    entry.cmd = header[1]
+
+    dstAddr, dstPort, err := readAddrPort(conn, header[3])
+    if err != nil {
+        if err == errUnsupportedAtyp {
+            writeReply(conn, REP_ATYP_NOT_SUPPORTED, nil, 0)
+            entry.reply = REP_ATYP_NOT_SUPPORTED
+        }
+        return err
+    }
+    entry.dstHost = dstAddr
+    entry.dstPort = dstPort
+
+    rules := config.Rules
+    if rules == nil {
+        rules = allowAll{}
+    }
+    if !rules.Allow(*authCtx, header[1], dstAddr, dstPort) {
+        writeReply(conn, REP_NOT_ALLOWED, nil, 0)
+        entry.reply = REP_NOT_ALLOWED
+        return fmt.Errorf("connection to %s:%d denied by rule set for user %q", dstAddr, dstPort, authCtx.Username)
+    }
+
+    switch header[1] {
+    case CMD_CONNECT:
+        return handleConnect(ctx, conn, config, dstAddr, dstPort, limits, entry)
+    case CMD_BIND:
+        return handleBind(conn, config, dstAddr, dstPort, limits, entry)
+    case CMD_UDP_ASSOCIATE:
+        return handleUDPAssociate(conn, config, *authCtx, entry)
+    default:
         writeReply(conn, REP_CMD_NOT_SUPPORTED, nil, 0)
-        return errors.New("only CONNECT command is supported")
+        entry.reply = REP_CMD_NOT_SUPPORTED
+        return fmt.Errorf("unsupported command: 0x%02x", header[1])
     }
-    
-    // Read and process destination address
+}
+
+// errUnsupportedAtyp signals an address type the server does not understand
+var errUnsupportedAtyp = errors.New("unsupported address type")
+
+// Read a SOCKS5 DST.ADDR/DST.PORT pair for the given address type
+func readAddrPort(conn io.Reader, atyp byte) (string, uint16, error) {
     var dstAddr string
-    var dstPort uint16
-    
-    switch header[3] {
+
+    switch atyp {
     case ATYP_IPV4:
-	// IPv4
-	ipv4 := make([]byte, 4)
-	if _, err := io.ReadFull(conn, ipv4); err != nil {
-	    return err
-	}
-	dstAddr = net.IPv4(ipv4[0], ipv4[1], ipv4[2], ipv4[3]).String()
-	
+        ipv4 := make([]byte, 4)
+        if _, err := io.ReadFull(conn, ipv4); err != nil {
+            return "", 0, err
+        }
+        dstAddr = net.IPv4(ipv4[0], ipv4[1], ipv4[2], ipv4[3]).String()
+
     case ATYP_DOMAINNAME:
-	// Domain name
-	domainLenBuff := make([]byte, 1)
-	if _, err := io.ReadFull(conn, domainLenBuff); err != nil {
-	    return err
-	}
-	domainLen := int(domainLenBuff[0])
-	
-	domain := make([]byte, domainLen)
-	if _, err := io.ReadFull(conn, domain); err != nil {
-	    return err
-	}
-	dstAddr = string(domain)
-	
+        domainLenBuff := make([]byte, 1)
+        if _, err := io.ReadFull(conn, domainLenBuff); err != nil {
+            return "", 0, err
+        }
+        domainLen := int(domainLenBuff[0])
+
+        domain := make([]byte, domainLen)
+        if _, err := io.ReadFull(conn, domain); err != nil {
+            return "", 0, err
+        }
+        dstAddr = string(domain)
+
     case ATYP_IPV6:
-	// IPv6
-	ipv6 := make([]byte, 16)
-	if _, err := io.ReadFull(conn, ipv6); err != nil {
-	    return err
-	}
-	dstAddr = net.IP(ipv6).String()
-	
+        ipv6 := make([]byte, 16)
+        if _, err := io.ReadFull(conn, ipv6); err != nil {
+            return "", 0, err
+        }
+        dstAddr = net.IP(ipv6).String()
+
     default:
-        writeReply(conn, REP_ATYP_NOT_SUPPORTED, nil, 0)
-        return errors.New("unsupported address type")
+        return "", 0, errUnsupportedAtyp
     }
-    
-    // Read port
+
     portBuff := make([]byte, 2)
     if _, err := io.ReadFull(conn, portBuff); err != nil {
-	return err
+        return "", 0, err
     }
-    dstPort = binary.BigEndian.Uint16(portBuff)
-    
-    // Create connection to target host
+    return dstAddr, binary.BigEndian.Uint16(portBuff), nil
+}
+
+// Handle CMD_CONNECT: dial the destination, either directly or redispatched
+// through an upstream chain, and splice
+func handleConnect(ctx context.Context, conn net.Conn, config *Config, dstAddr string, dstPort uint16, limits UserLimits, entry *accessEntry) error {
+    targetAddr := fmt.Sprintf("%s:%d", dstAddr, dstPort)
+
+    _, endDial := startSpan(ctx, "dial")
+    dialStart := time.Now()
     var targetConn net.Conn
     var err error
-    
-    targetAddr := fmt.Sprintf("%s:%d", dstAddr, dstPort)
-    log.Printf("Connecting to %s", targetAddr)
-    
-    dialer := &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}
-    if config.OutboundIface != "" {
-        if ip := getInterfaceIP(config.OutboundIface); ip != nil {
-            dialer.LocalAddr = &net.TCPAddr{IP: ip}
-        }
+    if chain := config.chainFor(dstAddr); chain != nil {
+        log.Printf("Connecting to %s via upstream chain %q", targetAddr, chain.name)
+        targetConn, err = dialViaChain(chain, config, targetAddr)
+    } else {
+        log.Printf("Connecting to %s", targetAddr)
+        targetConn, err = dialHappyEyeballs(ctx, config, entry.user, dstAddr, dstPort)
     }
-    targetConn, err = dialer.Dial("tcp", targetAddr)
-    
+    metrics.dialLatency.Observe(time.Since(dialStart).Seconds())
+    endDial()
     if err != nil {
         log.Printf("Failed to connect to %s: %v", targetAddr, err)
-        writeReply(conn, mapDialError(err), nil, 0)
+        rep := mapDialError(err)
+        writeReply(conn, rep, nil, 0)
+        entry.reply = rep
         return err
     }
     defer targetConn.Close()
-    
+
     // Send success response
     localAddr := targetConn.LocalAddr().(*net.TCPAddr)
     ipBytes := localAddr.IP.To4()
     if ipBytes == nil {
-	ipBytes = localAddr.IP.To16()
+        ipBytes = localAddr.IP.To16()
     }
-    
+
     if err := writeBoundSuccess(conn, ipBytes, uint16(localAddr.Port)); err != nil {
         return err
     }
-    
+    entry.reply = REP_SUCCESS
+
     // Clear deadlines for long-lived proxying
     conn.SetDeadline(time.Time{})
     if tc, ok := targetConn.(*net.TCPConn); ok {
@@ -397,62 +496,143 @@ func handleRequest(conn net.Conn, config *Config) error {
         tc.SetKeepAlivePeriod(30 * time.Second)
     }
 
-    // Forward data between connections
+    metrics.activeTunnels.Inc()
+    _, endRelay := startSpan(ctx, "relay")
+    entry.bytesUp, entry.bytesDown = proxyData(conn, targetConn, limits)
+    endRelay()
+    metrics.activeTunnels.Dec()
+    metrics.recordTunnel(entry.user, entry.bytesUp, entry.bytesDown)
+    return nil
+}
+
+// Handle CMD_BIND: listen on the outbound interface, wait for a single
+// inbound connection, then splice it with the control connection.
+// Upstream chains are not consulted here; BIND always listens locally.
+func handleBind(conn net.Conn, config *Config, dstAddr string, dstPort uint16, limits UserLimits, entry *accessEntry) error {
+    var laddr net.TCPAddr
+    if ip := config.egressIP(entry.user, dstAddr, hostIsIPv6(dstAddr)); ip != nil {
+        laddr.IP = ip
+    }
+
+    ln, err := net.ListenTCP("tcp", &laddr)
+    if err != nil {
+        log.Printf("BIND: failed to listen: %v", err)
+        writeReply(conn, REP_GENERAL_FAILURE, nil, 0)
+        entry.reply = REP_GENERAL_FAILURE
+        return err
+    }
+    defer ln.Close()
+
+    // First reply: the address/port the client should tell its peer to connect to
+    boundAddr := ln.Addr().(*net.TCPAddr)
+    ipBytes := boundAddr.IP.To4()
+    if ipBytes == nil {
+        ipBytes = boundAddr.IP.To16()
+    }
+    if err := writeBoundSuccess(conn, ipBytes, uint16(boundAddr.Port)); err != nil {
+        return err
+    }
+
+    ln.SetDeadline(time.Now().Add(config.BindTimeout))
+    peerConn, err := ln.Accept()
+    if err != nil {
+        log.Printf("BIND: no inbound connection from %s:%d: %v", dstAddr, dstPort, err)
+        writeReply(conn, REP_GENERAL_FAILURE, nil, 0)
+        entry.reply = REP_GENERAL_FAILURE
+        return err
+    }
+    defer peerConn.Close()
+
+    // Second reply: address/port of the host that connected in
+    peerAddr := peerConn.RemoteAddr().(*net.TCPAddr)
+    peerIPBytes := peerAddr.IP.To4()
+    if peerIPBytes == nil {
+        peerIPBytes = peerAddr.IP.To16()
+    }
+    if err := writeBoundSuccess(conn, peerIPBytes, uint16(peerAddr.Port)); err != nil {
+        return err
+    }
+    entry.reply = REP_SUCCESS
+
+    conn.SetDeadline(time.Time{})
+    metrics.activeTunnels.Inc()
+    entry.bytesUp, entry.bytesDown = proxyData(conn, peerConn, limits)
+    metrics.activeTunnels.Dec()
+    metrics.recordTunnel(entry.user, entry.bytesUp, entry.bytesDown)
+    return nil
+}
+
+// Handle CMD_UDP_ASSOCIATE: allocate a UDP relay socket and keep it alive
+// for as long as the control connection stays open
+func handleUDPAssociate(conn net.Conn, config *Config, authCtx AuthContext, entry *accessEntry) error {
+    var laddr net.UDPAddr
+    if ip := config.egressIP(entry.user, entry.dstHost, hostIsIPv6(entry.dstHost)); ip != nil {
+        laddr.IP = ip
+    }
+
+    relayConn, err := net.ListenUDP("udp", &laddr)
+    if err != nil {
+        log.Printf("UDP ASSOCIATE: failed to listen: %v", err)
+        writeReply(conn, REP_GENERAL_FAILURE, nil, 0)
+        entry.reply = REP_GENERAL_FAILURE
+        return err
+    }
+    defer relayConn.Close()
+
+    boundAddr := relayConn.LocalAddr().(*net.UDPAddr)
+    ipBytes := boundAddr.IP.To4()
+    if ipBytes == nil {
+        ipBytes = boundAddr.IP.To16()
+    }
+    if err := writeBoundSuccess(conn, ipBytes, uint16(boundAddr.Port)); err != nil {
+        return err
+    }
+    entry.reply = REP_SUCCESS
+
+    assoc := newUDPAssociation(relayConn, config, authCtx)
+    go assoc.serve()
+    defer assoc.close()
+
+    conn.SetDeadline(time.Time{})
+    // The association lives as long as the TCP control connection does;
+    // block here until it's closed by the client or the network.
+    io.Copy(io.Discard, conn)
+    return nil
+}
+
+// proxyData splices two connections until either side closes, returning
+// how many bytes moved in each direction for access logging and metrics.
+func proxyData(a, b net.Conn, limits UserLimits) (bytesUp, bytesDown int64) {
+    upBucket := newTokenBucket(limits.BytesPerSecUp)
+    downBucket := newTokenBucket(limits.BytesPerSecDown)
+
     var wg sync.WaitGroup
     wg.Add(2)
-    
-    // Client -> Server
+
+    // a -> b (upload)
     go func() {
         defer wg.Done()
         buf := getBuf()
-        io.CopyBuffer(targetConn, conn, buf)
+        bytesUp, _ = io.CopyBuffer(b, &throttledReader{r: a, bucket: upBucket}, buf)
         putBuf(buf)
-        if tc, ok := targetConn.(*net.TCPConn); ok {
+        if tc, ok := b.(*net.TCPConn); ok {
             tc.CloseWrite()
         }
     }()
-    
-    // Server -> Client
+
+    // b -> a (download)
     go func() {
         defer wg.Done()
         buf := getBuf()
-        io.CopyBuffer(conn, targetConn, buf)
+        bytesDown, _ = io.CopyBuffer(a, &throttledReader{r: b, bucket: downBucket}, buf)
         putBuf(buf)
-        if tc, ok := conn.(*net.TCPConn); ok {
+        if tc, ok := a.(*net.TCPConn); ok {
             tc.CloseWrite()
         }
     }()
-    
-    wg.Wait()
-    return nil
-}
 
-// Get IP address of specified interface
-func getInterfaceIP(ifaceName string) net.IP {
-    iface, err := net.InterfaceByName(ifaceName)
-    if err != nil {
-	log.Printf("Error getting interface %s: %v", ifaceName, err)
-	return nil
-    }
-    
-    addrs, err := iface.Addrs()
-    if err != nil {
-	log.Printf("Error getting addresses for interface %s: %v", ifaceName, err)
-	return nil
-    }
-    
-    for _, addr := range addrs {
-	switch v := addr.(type) {
-	case *net.IPNet:
-	    if !v.IP.IsLoopback() {
-		if v.IP.To4() != nil {
-		    return v.IP
-		}
-	    }
-	}
-    }
-    
-    return nil
+    wg.Wait()
+    return bytesUp, bytesDown
 }
 
 // Helper: write a generic reply with optional bind addr/port
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics is the process-wide Prometheus registry, exposed on
+// --metrics-addr. Like quotas, it lives outside Config so every call site
+// can record against it without threading a reference through the
+// (possibly hot-reloaded) config.
+var metrics = newMetricsRegistry()
+
+// metricsRegistry groups the collectors the proxy exposes at /metrics.
+type metricsRegistry struct {
+    connectionsTotal *prometheus.CounterVec
+    activeTunnels    prometheus.Gauge
+    dialLatency      prometheus.Histogram
+    bytesTransferred *prometheus.HistogramVec
+    userBytesTotal   *prometheus.CounterVec
+}
+
+func newMetricsRegistry() *metricsRegistry {
+    return &metricsRegistry{
+        connectionsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+            Name: "microsocks_connections_total",
+            Help: "SOCKS5 connections handled, labeled by auth method and final reply code.",
+        }, []string{"auth_method", "reply_code"}),
+        activeTunnels: promauto.NewGauge(prometheus.GaugeOpts{
+            Name: "microsocks_active_tunnels",
+            Help: "CONNECT/BIND tunnels currently relaying data.",
+        }),
+        dialLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+            Name:    "microsocks_dial_latency_seconds",
+            Help:    "Time to establish the outbound connection, direct or via an upstream chain.",
+            Buckets: prometheus.DefBuckets,
+        }),
+        bytesTransferred: promauto.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "microsocks_bytes_transferred",
+            Help:    "Bytes transferred per tunnel, labeled by direction.",
+            Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+        }, []string{"direction"}),
+        userBytesTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+            Name: "microsocks_user_bytes_total",
+            Help: "Cumulative bytes transferred, labeled by user and direction.",
+        }, []string{"user", "direction"}),
+    }
+}
+
+// recordConnection is called once handleConnection knows how the request
+// was ultimately answered.
+func (m *metricsRegistry) recordConnection(authMethod, rep byte) {
+    m.connectionsTotal.WithLabelValues(authMethodLabel(authMethod), replyCodeLabel(rep)).Inc()
+}
+
+// recordTunnel accounts for one finished CONNECT/BIND tunnel's transfer.
+func (m *metricsRegistry) recordTunnel(user string, bytesUp, bytesDown int64) {
+    m.bytesTransferred.WithLabelValues("up").Observe(float64(bytesUp))
+    m.bytesTransferred.WithLabelValues("down").Observe(float64(bytesDown))
+    if user == "" {
+        return
+    }
+    m.userBytesTotal.WithLabelValues(user, "up").Add(float64(bytesUp))
+    m.userBytesTotal.WithLabelValues(user, "down").Add(float64(bytesDown))
+}
+
+func authMethodLabel(method byte) string {
+    switch method {
+    case AUTH_NONE:
+        return "none"
+    case AUTH_USERNAME:
+        return "username"
+    case AUTH_GSSAPI:
+        return "gssapi"
+    default:
+        return fmt.Sprintf("0x%02x", method)
+    }
+}
+
+func replyCodeLabel(rep byte) string {
+    if rep == replyAuthFailed {
+        return "auth_failed"
+    }
+    return fmt.Sprintf("0x%02x", rep)
+}
+
+// serveMetrics exposes the registered collectors on addr at /metrics until
+// the process exits. Failures are logged rather than fatal: metrics are an
+// optional add-on and shouldn't take the proxy down with them.
+func serveMetrics(addr string) {
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", promhttp.Handler())
+    log.Printf("Metrics listening on %s", addr)
+    if err := http.ListenAndServe(addr, mux); err != nil {
+        log.Printf("Metrics server error: %v", err)
+    }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+// UserLimits caps what a single authenticated user can do concurrently.
+// A zero value in any field means "unlimited".
+type UserLimits struct {
+    BytesPerSecUp   int64
+    BytesPerSecDown int64
+    MaxConns        int
+    IdleTimeout     time.Duration
+}
+
+// quotaTracker enforces MaxConns per user across the life of the server.
+type quotaTracker struct {
+    mu    sync.Mutex
+    conns map[string]int
+}
+
+func newQuotaTracker() *quotaTracker {
+    return &quotaTracker{conns: make(map[string]int)}
+}
+
+// acquire reserves a connection slot for user under limits.MaxConns. It
+// returns false if the user is already at their limit.
+func (q *quotaTracker) acquire(user string, limits UserLimits) bool {
+    if limits.MaxConns <= 0 {
+        return true
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.conns[user] >= limits.MaxConns {
+        return false
+    }
+    q.conns[user]++
+    return true
+}
+
+func (q *quotaTracker) release(user string, limits UserLimits) {
+    if limits.MaxConns <= 0 {
+        return
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.conns[user]--
+    if q.conns[user] <= 0 {
+        delete(q.conns, user)
+    }
+}
+
+// tokenBucket is a minimal bytes/sec limiter: it refills continuously and
+// blocks the caller for however long is needed to stay under rate.
+type tokenBucket struct {
+    mu         sync.Mutex
+    rate       int64 // bytes/sec; <= 0 means unlimited
+    tokens     float64
+    burst      float64
+    lastRefill time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+    burst := float64(bytesPerSec)
+    if burst <= 0 {
+        burst = 0
+    }
+    return &tokenBucket{rate: bytesPerSec, tokens: burst, burst: burst, lastRefill: time.Now()}
+}
+
+// wait blocks until n bytes' worth of tokens are available, then spends
+// them. It's a no-op when the bucket is unlimited.
+func (b *tokenBucket) wait(n int) {
+    if b == nil || b.rate <= 0 {
+        return
+    }
+    for {
+        b.mu.Lock()
+        now := time.Now()
+        elapsed := now.Sub(b.lastRefill).Seconds()
+        b.lastRefill = now
+        b.tokens += elapsed * float64(b.rate)
+        if b.tokens > b.burst {
+            b.tokens = b.burst
+        }
+        if b.tokens >= float64(n) {
+            b.tokens -= float64(n)
+            b.mu.Unlock()
+            return
+        }
+        deficit := float64(n) - b.tokens
+        wait := time.Duration(deficit / float64(b.rate) * float64(time.Second))
+        b.mu.Unlock()
+        time.Sleep(wait)
+    }
+}
+
+// throttledReader wraps io.CopyBuffer's source so a per-user token bucket
+// rate-limits the copy.
+type throttledReader struct {
+    r      io.Reader
+    bucket *tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+    n, err := t.r.Read(p)
+    if n > 0 {
+        t.bucket.wait(n)
+    }
+    return n, err
+}
+
+// idleTimeoutConn resets a read/write deadline on every successful
+// operation, closing the connection if it goes quiet for longer than
+// timeout even though io.CopyBuffer never sets deadlines itself.
+type idleTimeoutConn struct {
+    net.Conn
+    timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+    c.Conn.SetDeadline(time.Now().Add(c.timeout))
+    return c.Conn.Read(p)
+}
+
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+    c.Conn.SetDeadline(time.Now().Add(c.timeout))
+    return c.Conn.Write(p)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "log"
+    "net"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "sync/atomic"
+    "syscall"
+
+    "github.com/fsnotify/fsnotify"
+)
+
+// runWithFileConfig loads config from a YAML file, starts a listener per
+// configured address, and hot-reloads the running Config whenever the
+// file changes on disk. Listener addresses themselves are not
+// re-evaluated on reload — only Config fields consulted per-connection
+// (auth, rules, upstream chains, user limits) take effect immediately.
+func runWithFileConfig(path string) {
+    config, err := loadFileConfig(path)
+    if err != nil {
+        log.Fatalf("Error loading config %s: %v", path, err)
+    }
+
+    if config.MetricsAddr != "" {
+        go serveMetrics(config.MetricsAddr)
+    }
+
+    var cfgPtr atomic.Pointer[Config]
+    cfgPtr.Store(config)
+
+    listeners := startListeners(config)
+    if len(listeners) == 0 {
+        log.Fatalf("No listeners configured in %s", path)
+    }
+    for _, ln := range listeners {
+        log.Printf("SOCKS5 proxy started on %s", ln.Addr())
+        go serve(ln, &cfgPtr)
+    }
+
+    go watchConfig(path, &cfgPtr)
+
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+    <-sigCh
+    log.Printf("Shutting down, closing listeners...")
+    for _, ln := range listeners {
+        ln.Close()
+    }
+}
+
+func startListeners(config *Config) []net.Listener {
+    addrs := append([]string{config.ListenAddr}, config.ExtraListenAddrs...)
+    var listeners []net.Listener
+    for _, addr := range addrs {
+        ln, err := net.Listen("tcp", addr)
+        if err != nil {
+            log.Fatalf("Failed to listen on %s: %v", addr, err)
+        }
+        listeners = append(listeners, ln)
+    }
+    return listeners
+}
+
+// watchConfig reloads path into cfgPtr whenever fsnotify reports it was
+// written, atomically swapping the pointer that serve()/handleConnection
+// read from. Connections already in flight keep the Config they started
+// with; only new connections see the reloaded one.
+//
+// It watches path's parent directory rather than path itself: editors
+// and config-management tools normally update a file "atomically" by
+// writing a temp file and rename()-ing it over the target, which fsnotify
+// reports as a Remove/Rename of the watched path, not a Write — and once
+// that happens the underlying inode is gone and a watch on the bare file
+// stops firing for good. Watching the directory and filtering on
+// event.Name survives the swap.
+func watchConfig(path string, cfgPtr *atomic.Pointer[Config]) {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        log.Printf("Config hot-reload disabled: %v", err)
+        return
+    }
+    defer watcher.Close()
+
+    dir := filepath.Dir(path)
+    if err := watcher.Add(dir); err != nil {
+        log.Printf("Config hot-reload disabled: %v", err)
+        return
+    }
+
+    for {
+        select {
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return
+            }
+            if filepath.Clean(event.Name) != filepath.Clean(path) {
+                continue
+            }
+            if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+                continue
+            }
+            if _, err := os.Stat(path); err != nil {
+                // Mid-swap: the old file was just removed/renamed away
+                // and the replacement hasn't been created yet. The
+                // Create event that follows will trigger the reload.
+                continue
+            }
+            newConfig, err := loadFileConfig(path)
+            if err != nil {
+                log.Printf("Config reload failed, keeping previous config: %v", err)
+                continue
+            }
+            cfgPtr.Store(newConfig)
+            log.Printf("Config reloaded from %s", path)
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return
+            }
+            log.Printf("Config watcher error: %v", err)
+        }
+    }
+}
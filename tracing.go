@@ -0,0 +1,27 @@
+package main
+
+import (
+    "context"
+
+    "go.opentelemetry.io/otel"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracer instruments each SOCKS session as a span, with sub-spans for
+// auth, dial, and relay, so operators can correlate a slow tunnel across
+// the proxy chain feature (upstream.go) using a single trace ID. No
+// exporter is registered here; an operator who wants spans shipped
+// somewhere (OTLP, Jaeger, …) calls otel.SetTracerProvider with their own
+// provider before main starts serving.
+var tracer = otel.Tracer("github.com/foxzi/micro-socks")
+
+func init() {
+    otel.SetTracerProvider(sdktrace.NewTracerProvider())
+}
+
+// startSpan is a thin wrapper so call sites don't need to import
+// go.opentelemetry.io/otel/trace just for the return type.
+func startSpan(ctx context.Context, name string) (context.Context, func()) {
+    ctx, span := tracer.Start(ctx, name)
+    return ctx, func() { span.End() }
+}
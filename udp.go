@@ -0,0 +1,215 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "strconv"
+    "sync"
+    "sync/atomic"
+)
+
+// udpAssociation relays datagrams for a single UDP ASSOCIATE session. The
+// client sends RFC 1928 framed datagrams to relayConn; each unique
+// destination gets its own dialed UDP socket so replies can be matched
+// back to the client without keeping per-packet state.
+type udpAssociation struct {
+    relayConn  *net.UDPConn
+    config     *Config
+    authCtx    AuthContext
+    clientAddr atomic.Value // *net.UDPAddr, learned from the first datagram
+
+    mu    sync.Mutex
+    dests map[string]*net.UDPConn
+}
+
+func newUDPAssociation(relayConn *net.UDPConn, config *Config, authCtx AuthContext) *udpAssociation {
+    return &udpAssociation{
+        relayConn: relayConn,
+        config:    config,
+        authCtx:   authCtx,
+        dests:     make(map[string]*net.UDPConn),
+    }
+}
+
+// serve reads datagrams from the client and forwards them to their
+// destinations until the relay socket is closed.
+func (a *udpAssociation) serve() {
+    buf := make([]byte, 65535)
+    for {
+        n, from, err := a.relayConn.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+
+        if v := a.clientAddr.Load(); v == nil {
+            a.clientAddr.Store(from)
+        } else if !addrEqual(v.(*net.UDPAddr), from) {
+            // Datagram from someone other than the associated client; ignore.
+            continue
+        }
+
+        pkt := make([]byte, n)
+        copy(pkt, buf[:n])
+        a.forward(pkt)
+    }
+}
+
+// forward parses the RFC 1928 UDP request header and relays the payload
+// to the destination it names.
+func (a *udpAssociation) forward(pkt []byte) {
+    if len(pkt) < 4 || pkt[2] != 0x00 {
+        return // malformed, or a fragment (FRAG != 0) which we don't support
+    }
+
+    dstAddr, dstPort, payload, ok := parseUDPHeader(pkt)
+    if !ok {
+        return
+    }
+
+    dest := a.getOrDialDest(dstAddr, dstPort)
+    if dest == nil {
+        return
+    }
+    dest.Write(payload)
+}
+
+// parseUDPHeader splits a client UDP request datagram into destination and
+// payload, per RFC 1928 section 7.
+func parseUDPHeader(pkt []byte) (dstAddr string, dstPort uint16, payload []byte, ok bool) {
+    atyp := pkt[3]
+    var off int
+
+    switch atyp {
+    case ATYP_IPV4:
+        if len(pkt) < 4+4+2 {
+            return "", 0, nil, false
+        }
+        dstAddr = net.IP(pkt[4:8]).String()
+        off = 8
+    case ATYP_IPV6:
+        if len(pkt) < 4+16+2 {
+            return "", 0, nil, false
+        }
+        dstAddr = net.IP(pkt[4:20]).String()
+        off = 20
+    case ATYP_DOMAINNAME:
+        if len(pkt) < 5 {
+            return "", 0, nil, false
+        }
+        l := int(pkt[4])
+        if len(pkt) < 5+l+2 {
+            return "", 0, nil, false
+        }
+        dstAddr = string(pkt[5 : 5+l])
+        off = 5 + l
+    default:
+        return "", 0, nil, false
+    }
+
+    dstPort = binary.BigEndian.Uint16(pkt[off : off+2])
+    return dstAddr, dstPort, pkt[off+2:], true
+}
+
+// getOrDialDest returns the UDP socket used to talk to dstHost:dstPort,
+// dialing and spawning its reply relay goroutine the first time it's
+// seen. The control connection's CMD_UDP_ASSOCIATE request is only ever
+// checked against its own DST.ADDR/PORT (typically 0.0.0.0:0, since the
+// client doesn't know its real destinations yet), so every new
+// destination named by a client datagram is re-checked against the rule
+// set here before it's dialed.
+func (a *udpAssociation) getOrDialDest(dstHost string, dstPort uint16) *net.UDPConn {
+    target := net.JoinHostPort(dstHost, strconv.Itoa(int(dstPort)))
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    if c, ok := a.dests[target]; ok {
+        return c
+    }
+
+    rules := a.config.Rules
+    if rules == nil {
+        rules = allowAll{}
+    }
+    if !rules.Allow(a.authCtx, CMD_UDP_ASSOCIATE, dstHost, dstPort) {
+        return nil
+    }
+
+    raddr, err := net.ResolveUDPAddr("udp", target)
+    if err != nil {
+        return nil
+    }
+    // dstHost may have been a domain name (ATYP_DOMAINNAME); re-check the
+    // rule set against the address it actually resolved to, since a CIDR
+    // rule matched against dstHost above wouldn't have fired for a
+    // hostname that happens to resolve into the blocked range.
+    if raddr.IP.String() != dstHost && !rules.Allow(a.authCtx, CMD_UDP_ASSOCIATE, raddr.IP.String(), dstPort) {
+        return nil
+    }
+
+    var laddr *net.UDPAddr
+    if ip := a.config.egressIP("", dstHost, raddr.IP.To4() == nil); ip != nil {
+        laddr = &net.UDPAddr{IP: ip}
+    }
+
+    c, err := net.DialUDP("udp", laddr, raddr)
+    if err != nil {
+        return nil
+    }
+    a.dests[target] = c
+    go a.relayReplies(c)
+    return c
+}
+
+// relayReplies reads datagrams back from a destination and wraps them in
+// the RFC 1928 header before writing them to the associated client.
+func (a *udpAssociation) relayReplies(dest *net.UDPConn) {
+    buf := make([]byte, 65535)
+    for {
+        n, err := dest.Read(buf)
+        if err != nil {
+            return
+        }
+
+        clientAddr, _ := a.clientAddr.Load().(*net.UDPAddr)
+        if clientAddr == nil {
+            continue
+        }
+
+        raddr := dest.RemoteAddr().(*net.UDPAddr)
+        pkt := append(buildUDPHeader(raddr), buf[:n]...)
+        a.relayConn.WriteToUDP(pkt, clientAddr)
+    }
+}
+
+// buildUDPHeader renders the RFC 1928 header pointing at addr.
+func buildUDPHeader(addr *net.UDPAddr) []byte {
+    var atyp byte
+    var ip net.IP
+    if v4 := addr.IP.To4(); v4 != nil {
+        atyp = ATYP_IPV4
+        ip = v4
+    } else {
+        atyp = ATYP_IPV6
+        ip = addr.IP.To16()
+    }
+
+    header := append([]byte{0x00, 0x00, 0x00, atyp}, ip...)
+    portBytes := make([]byte, 2)
+    binary.BigEndian.PutUint16(portBytes, uint16(addr.Port))
+    return append(header, portBytes...)
+}
+
+// close tears down the association and every destination socket it opened.
+func (a *udpAssociation) close() {
+    a.relayConn.Close()
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    for _, c := range a.dests {
+        c.Close()
+    }
+}
+
+func addrEqual(a, b *net.UDPAddr) bool {
+    return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "testing"
+)
+
+func TestParseUDPHeader(t *testing.T) {
+    buildIPv4 := func(ip net.IP, port uint16, payload []byte) []byte {
+        pkt := []byte{0x00, 0x00, 0x00, ATYP_IPV4}
+        pkt = append(pkt, ip.To4()...)
+        portBytes := make([]byte, 2)
+        binary.BigEndian.PutUint16(portBytes, port)
+        pkt = append(pkt, portBytes...)
+        return append(pkt, payload...)
+    }
+
+    buildDomain := func(host string, port uint16, payload []byte) []byte {
+        pkt := []byte{0x00, 0x00, 0x00, ATYP_DOMAINNAME, byte(len(host))}
+        pkt = append(pkt, host...)
+        portBytes := make([]byte, 2)
+        binary.BigEndian.PutUint16(portBytes, port)
+        pkt = append(pkt, portBytes...)
+        return append(pkt, payload...)
+    }
+
+    t.Run("ipv4", func(t *testing.T) {
+        pkt := buildIPv4(net.IPv4(203, 0, 113, 1), 443, []byte("hello"))
+        host, port, payload, ok := parseUDPHeader(pkt)
+        if !ok || host != "203.0.113.1" || port != 443 || string(payload) != "hello" {
+            t.Fatalf("got host=%q port=%d payload=%q ok=%v", host, port, payload, ok)
+        }
+    })
+
+    t.Run("domain", func(t *testing.T) {
+        pkt := buildDomain("example.com", 53, []byte("x"))
+        host, port, payload, ok := parseUDPHeader(pkt)
+        if !ok || host != "example.com" || port != 53 || string(payload) != "x" {
+            t.Fatalf("got host=%q port=%d payload=%q ok=%v", host, port, payload, ok)
+        }
+    })
+
+    t.Run("truncated ipv4", func(t *testing.T) {
+        pkt := []byte{0x00, 0x00, 0x00, ATYP_IPV4, 1, 2, 3}
+        if _, _, _, ok := parseUDPHeader(pkt); ok {
+            t.Fatal("expected truncated packet to be rejected")
+        }
+    })
+
+    t.Run("truncated domain length", func(t *testing.T) {
+        pkt := []byte{0x00, 0x00, 0x00, ATYP_DOMAINNAME, 10, 'a', 'b'}
+        if _, _, _, ok := parseUDPHeader(pkt); ok {
+            t.Fatal("expected truncated domain packet to be rejected")
+        }
+    })
+
+    t.Run("unknown atyp", func(t *testing.T) {
+        pkt := []byte{0x00, 0x00, 0x00, 0xFF, 0, 0}
+        if _, _, _, ok := parseUDPHeader(pkt); ok {
+            t.Fatal("expected unknown ATYP to be rejected")
+        }
+    })
+}
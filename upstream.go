@@ -0,0 +1,286 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// upstreamHop is one SOCKS5 proxy in a redispatch chain.
+type upstreamHop struct {
+    addr     string
+    username string
+    password string
+}
+
+// upstreamChain is an ordered list of hops the server tunnels a request
+// through before it reaches the real destination.
+type upstreamChain struct {
+    name string
+    hops []upstreamHop
+}
+
+// upstreamRoute maps a destination pattern to the chain that should carry
+// it. Routes are evaluated in order; the first match wins.
+type upstreamRoute struct {
+    pattern string
+    chain   string
+}
+
+// matches reports whether host satisfies the route's pattern, which may be
+// a CIDR block, a "*.suffix" domain glob, or an exact host match.
+func (r upstreamRoute) matches(host string) bool {
+    if _, cidr, err := net.ParseCIDR(r.pattern); err == nil {
+        ip := net.ParseIP(host)
+        return ip != nil && cidr.Contains(ip)
+    }
+    if suffix, ok := strings.CutPrefix(r.pattern, "*."); ok {
+        return strings.HasSuffix(host, "."+suffix) || host == suffix
+    }
+    return strings.EqualFold(r.pattern, host)
+}
+
+// chainFor resolves which upstream chain should carry a connection to
+// host, following config.Routes in order and falling back to a chain
+// named "default" if one is configured. A nil result means: dial direct.
+func (c *Config) chainFor(host string) *upstreamChain {
+    for _, r := range c.Routes {
+        if !r.matches(host) {
+            continue
+        }
+        if r.chain == "direct" {
+            return nil
+        }
+        if chain, ok := c.UpstreamChains[r.chain]; ok {
+            return chain
+        }
+        return nil
+    }
+    return c.UpstreamChains["default"]
+}
+
+// parseUpstreamChains parses the --upstream flag value:
+//
+//	[name=]socks5://[user:pass@]host:port[,socks5://...][;[name=]socks5://...]
+//
+// Each ";"-separated segment defines one named chain (default name
+// "default"); the comma-separated URLs within it are the ordered hops.
+func parseUpstreamChains(spec string) (map[string]*upstreamChain, error) {
+    chains := make(map[string]*upstreamChain)
+    if spec == "" {
+        return chains, nil
+    }
+
+    for _, chainSpec := range strings.Split(spec, ";") {
+        chainSpec = strings.TrimSpace(chainSpec)
+        if chainSpec == "" {
+            continue
+        }
+
+        name := "default"
+        if idx := strings.Index(chainSpec, "="); idx != -1 && !strings.Contains(chainSpec[:idx], "://") {
+            name = chainSpec[:idx]
+            chainSpec = chainSpec[idx+1:]
+        }
+
+        var hops []upstreamHop
+        for _, raw := range strings.Split(chainSpec, ",") {
+            raw = strings.TrimSpace(raw)
+            if raw == "" {
+                continue
+            }
+            hop, err := parseUpstreamHop(raw)
+            if err != nil {
+                return nil, fmt.Errorf("chain %q: %w", name, err)
+            }
+            hops = append(hops, hop)
+        }
+        if len(hops) == 0 {
+            return nil, fmt.Errorf("chain %q has no hops", name)
+        }
+        chains[name] = &upstreamChain{name: name, hops: hops}
+    }
+    return chains, nil
+}
+
+func parseUpstreamHop(raw string) (upstreamHop, error) {
+    u, err := url.Parse(raw)
+    if err != nil {
+        return upstreamHop{}, fmt.Errorf("invalid upstream URL %q: %w", raw, err)
+    }
+    if u.Scheme != "socks5" {
+        return upstreamHop{}, fmt.Errorf("unsupported upstream scheme %q (only socks5:// is supported)", u.Scheme)
+    }
+    hop := upstreamHop{addr: u.Host}
+    if u.User != nil {
+        hop.username = u.User.Username()
+        hop.password, _ = u.User.Password()
+    }
+    return hop, nil
+}
+
+// parseUpstreamRoutes parses the --upstream-routes flag value:
+// "pattern=chain,pattern=chain,...".
+func parseUpstreamRoutes(spec string) ([]upstreamRoute, error) {
+    var routes []upstreamRoute
+    if spec == "" {
+        return routes, nil
+    }
+    for _, raw := range strings.Split(spec, ",") {
+        raw = strings.TrimSpace(raw)
+        if raw == "" {
+            continue
+        }
+        idx := strings.Index(raw, "=")
+        if idx == -1 {
+            return nil, fmt.Errorf("invalid route %q, expected pattern=chain", raw)
+        }
+        routes = append(routes, upstreamRoute{pattern: raw[:idx], chain: raw[idx+1:]})
+    }
+    return routes, nil
+}
+
+// validateUpstreamRoutes rejects any route whose chain isn't "direct" and
+// doesn't name a chain present in chains. A route with a typo'd or
+// never-configured chain name would otherwise fall through chainFor's
+// lookup and fail open to a direct connection — silently defeating the
+// whole point of a route meant to force traffic through a specific
+// upstream.
+func validateUpstreamRoutes(routes []upstreamRoute, chains map[string]*upstreamChain) error {
+    for _, r := range routes {
+        if r.chain == "direct" {
+            continue
+        }
+        if _, ok := chains[r.chain]; !ok {
+            return fmt.Errorf("route %q references undefined upstream chain %q", r.pattern, r.chain)
+        }
+    }
+    return nil
+}
+
+// dialViaChain establishes a TCP connection to targetAddr by tunneling a
+// CONNECT request through each hop of chain in turn.
+func dialViaChain(chain *upstreamChain, config *Config, targetAddr string) (net.Conn, error) {
+    if len(chain.hops) == 0 {
+        return nil, errors.New("upstream chain has no hops")
+    }
+
+    dialer := &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}
+    hopHost, _, _ := net.SplitHostPort(chain.hops[0].addr)
+    if ip := config.egressIP("", hopHost, hostIsIPv6(hopHost)); ip != nil {
+        dialer.LocalAddr = &net.TCPAddr{IP: ip}
+    }
+
+    conn, err := dialer.Dial("tcp", chain.hops[0].addr)
+    if err != nil {
+        return nil, fmt.Errorf("dialing upstream %s: %w", chain.hops[0].addr, err)
+    }
+
+    for i, hop := range chain.hops {
+        nextAddr := targetAddr
+        if i+1 < len(chain.hops) {
+            nextAddr = chain.hops[i+1].addr
+        }
+        if err := socks5ClientConnect(conn, hop, nextAddr); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("redispatch via %s to %s: %w", hop.addr, nextAddr, err)
+        }
+    }
+    return conn, nil
+}
+
+// socks5ClientConnect performs a client-side SOCKS5 handshake and CONNECT
+// request over conn, targeting dstAddr ("host:port"). conn gets a deadline
+// for the duration of the handshake so an upstream hop that accepts the
+// TCP connection but never answers doesn't block the calling goroutine
+// forever; it's cleared before returning so the caller can splice conn
+// without an inherited deadline.
+func socks5ClientConnect(conn net.Conn, hop upstreamHop, dstAddr string) error {
+    conn.SetDeadline(time.Now().Add(15 * time.Second))
+    defer conn.SetDeadline(time.Time{})
+
+    methods := []byte{AUTH_NONE}
+    if hop.username != "" {
+        methods = []byte{AUTH_USERNAME}
+    }
+
+    greeting := append([]byte{VERSION, byte(len(methods))}, methods...)
+    if _, err := conn.Write(greeting); err != nil {
+        return err
+    }
+
+    reply := make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return err
+    }
+    if reply[0] != VERSION {
+        return errors.New("upstream: invalid protocol version")
+    }
+    if reply[1] == AUTH_NOACCEPT {
+        return errors.New("upstream: no acceptable authentication method")
+    }
+
+    if reply[1] == AUTH_USERNAME {
+        authReq := []byte{0x01, byte(len(hop.username))}
+        authReq = append(authReq, hop.username...)
+        authReq = append(authReq, byte(len(hop.password)))
+        authReq = append(authReq, hop.password...)
+        if _, err := conn.Write(authReq); err != nil {
+            return err
+        }
+        authReply := make([]byte, 2)
+        if _, err := io.ReadFull(conn, authReply); err != nil {
+            return err
+        }
+        if authReply[1] != 0x00 {
+            return errors.New("upstream: authentication rejected")
+        }
+    }
+
+    host, portStr, err := net.SplitHostPort(dstAddr)
+    if err != nil {
+        return fmt.Errorf("invalid destination %q: %w", dstAddr, err)
+    }
+    var port uint16
+    if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
+        return fmt.Errorf("invalid destination port %q: %w", portStr, err)
+    }
+
+    req := []byte{VERSION, CMD_CONNECT, 0x00, ATYP_DOMAINNAME, byte(len(host))}
+    req = append(req, host...)
+    portBytes := make([]byte, 2)
+    binary.BigEndian.PutUint16(portBytes, port)
+    req = append(req, portBytes...)
+    if ip := net.ParseIP(host); ip != nil {
+        if v4 := ip.To4(); v4 != nil {
+            req = []byte{VERSION, CMD_CONNECT, 0x00, ATYP_IPV4}
+            req = append(req, v4...)
+            req = append(req, portBytes...)
+        } else {
+            req = []byte{VERSION, CMD_CONNECT, 0x00, ATYP_IPV6}
+            req = append(req, ip.To16()...)
+            req = append(req, portBytes...)
+        }
+    }
+    if _, err := conn.Write(req); err != nil {
+        return err
+    }
+
+    respHeader := make([]byte, 4)
+    if _, err := io.ReadFull(conn, respHeader); err != nil {
+        return err
+    }
+    if respHeader[1] != REP_SUCCESS {
+        return fmt.Errorf("upstream refused CONNECT: reply code 0x%02x", respHeader[1])
+    }
+    // Discard the BND.ADDR/BND.PORT that follows; we don't need it.
+    if _, _, err := readAddrPort(conn, respHeader[3]); err != nil {
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestUpstreamRouteMatches(t *testing.T) {
+    cases := []struct {
+        name    string
+        pattern string
+        host    string
+        want    bool
+    }{
+        {"cidr hit", "10.0.0.0/8", "10.1.2.3", true},
+        {"cidr miss", "10.0.0.0/8", "192.168.1.1", false},
+        {"cidr does not match a hostname", "10.0.0.0/8", "internal.evil.com", false},
+        {"domain glob suffix", "*.onion", "foo.onion", true},
+        {"domain glob exact suffix host", "*.onion", "onion", true},
+        {"domain glob miss", "*.onion", "example.com", false},
+        {"exact host match", "example.com", "example.com", true},
+        {"exact host case-insensitive", "Example.COM", "example.com", true},
+        {"exact host miss", "example.com", "example.org", false},
+    }
+
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            r := upstreamRoute{pattern: c.pattern}
+            if got := r.matches(c.host); got != c.want {
+                t.Errorf("matches(%q) against pattern %q = %v, want %v", c.host, c.pattern, got, c.want)
+            }
+        })
+    }
+}
+
+func TestConfigChainFor(t *testing.T) {
+    tor := &upstreamChain{name: "tor"}
+    def := &upstreamChain{name: "default"}
+    config := &Config{
+        UpstreamChains: map[string]*upstreamChain{"tor": tor, "default": def},
+        Routes: []upstreamRoute{
+            {pattern: "*.onion", chain: "tor"},
+            {pattern: "10.0.0.0/8", chain: "direct"},
+        },
+    }
+
+    if got := config.chainFor("foo.onion"); got != tor {
+        t.Errorf("chainFor(foo.onion) = %v, want tor chain", got)
+    }
+    if got := config.chainFor("10.1.2.3"); got != nil {
+        t.Errorf("chainFor(10.1.2.3) = %v, want nil (direct)", got)
+    }
+    if got := config.chainFor("example.com"); got != def {
+        t.Errorf("chainFor(example.com) = %v, want default chain", got)
+    }
+}
+
+func TestValidateUpstreamRoutes(t *testing.T) {
+    chains := map[string]*upstreamChain{"tor": {name: "tor"}}
+
+    if err := validateUpstreamRoutes([]upstreamRoute{{pattern: "*.onion", chain: "tor"}}, chains); err != nil {
+        t.Errorf("expected a route to a configured chain to validate, got: %v", err)
+    }
+    if err := validateUpstreamRoutes([]upstreamRoute{{pattern: "10.0.0.0/8", chain: "direct"}}, chains); err != nil {
+        t.Errorf("expected the reserved \"direct\" chain to validate, got: %v", err)
+    }
+    if err := validateUpstreamRoutes([]upstreamRoute{{pattern: "*.onion", chain: "Tor"}}, chains); err == nil {
+        t.Error("expected a route to an undefined chain name to be rejected")
+    }
+}